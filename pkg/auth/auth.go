@@ -15,12 +15,8 @@
 package auth
 
 import (
-	"crypto/tls"
-	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"net"
 	"net/http"
 	"os"
 	"strings"
@@ -37,19 +33,38 @@ type AuthScope struct {
 	Actions    string
 }
 
+// RegAuthContext's AuthTokens and Challenges caches are safe for
+// concurrent use, but ReqHost, AuthScheme, Realm, Service and Scope are
+// plain mutable state updated in place by
+// PingV2/PrepareAuth/SendRequestWithToken/AuthorizeScopes: don't mutate or read
+// them from multiple goroutines concurrently.
 type RegAuthContext struct {
 	Hclient    *http.Client
 	RegURL     string
 	ReqHost    string
-	AuthTokens map[string]string
 
-	Realm   string
-	Service string
-	Scope   AuthScope
-}
-
-type TokenStruct struct {
-	Token string `json:"token"`
+	// AuthTokens caches bearer tokens per (host, scope), safe for
+	// concurrent use by multiple goroutines sharing this context.
+	AuthTokens *tokenCache
+
+	// Creds supplies credentials for Basic authentication against the
+	// registry and for the token server's login flow. May be left nil
+	// for anonymous/pull-only access.
+	Creds CredentialStore
+
+	// Challenges caches the WWW-Authenticate challenges seen per
+	// endpoint, so a single RegAuthContext can be reused across many
+	// endpoints without re-probing each one. Populated by PingV2 and
+	// consulted by PrepareAuth.
+	Challenges *ChallengeManager
+
+	// AuthScheme is the scheme (e.g. "bearer" or "basic") selected out
+	// of the challenges the registry advertised in its WWW-Authenticate
+	// header.
+	AuthScheme string
+	Realm      string
+	Service    string
+	Scope      AuthScope
 }
 
 func init() {
@@ -59,105 +74,119 @@ func init() {
 	}
 }
 
+// NewRegAuthContext returns a RegAuthContext that verifies TLS
+// certificates against the system root pool. Use
+// NewRegAuthContextWithOptions to customize TLS behavior (e.g. for
+// self-signed registries or mTLS).
 func NewRegAuthContext() RegAuthContext {
+	// Options{} has no CertsDir to read, so building its HTTP client
+	// cannot fail.
+	sc, _ := NewRegAuthContextWithOptions(Options{})
+	return sc
+}
+
+// NewRegAuthContextWithOptions returns a RegAuthContext whose HTTP
+// client is configured per opts. It errors if opts.CertsDir is set but
+// its contents can't be read or parsed as certs.d material.
+func NewRegAuthContextWithOptions(opts Options) (RegAuthContext, error) {
+	hclient, err := newHTTPClient(opts)
+	if err != nil {
+		return RegAuthContext{}, fmt.Errorf("failed to configure HTTP client: %v", err)
+	}
+
 	return RegAuthContext{
-		Hclient:    newHTTPClient(),
+		Hclient:    hclient,
 		RegURL:     defaultRegURL,
-		AuthTokens: make(map[string]string),
+		AuthTokens: newTokenCache(),
+		Challenges: NewChallengeManager(),
 		Scope: AuthScope{
 			RemoteName: "",
 			Actions:    "*",
 		},
-	}
+	}, nil
 }
 
-// Get challenges from the index server, to be able to get necessary
-// info like bearer realm, service, and scope, by parsing the www-authenticate
-// header in the response.
+// PrepareAuth pings the index server's v2 API to learn how it wants
+// clients to authenticate, then selects the strongest scheme it
+// advertises, fetching a token up front for Bearer. The ping and its challenges are cached in sc.Challenges,
+// so calling PrepareAuth again for an endpoint this context has already
+// probed consults that cache instead of issuing another unauthenticated
+// probe.
 func (sc *RegAuthContext) PrepareAuth(indexServer string) error {
-	inputURL := "https://" + indexServer + "/v2/"
-
-	req, res, err := sc.SendRequestWithToken(inputURL, "GET", nil)
-	if err != nil {
-		return fmt.Errorf("failed to send request to %s: %v", inputURL, err)
-	}
+	endpoint := "https://" + indexServer
+	pingURL := endpoint + "/v2/"
 
-	sc.ReqHost = req.URL.Host
-
-	wwwAuthHdr := res.Header.Get("www-authenticate")
-	if res.StatusCode != http.StatusUnauthorized || wwwAuthHdr == "" {
-		return fmt.Errorf("received invalid result: %v", res)
-	}
-
-	tokens := strings.Split(wwwAuthHdr, ",")
-
-	for _, token := range tokens {
-		if strings.HasPrefix(strings.ToLower(token), "bearer realm") {
-			sc.Realm = strings.Trim(token[len("bearer realm="):], "\"")
-		}
-		if strings.HasPrefix(token, "service") {
-			sc.Service = strings.Trim(token[len("service="):], "\"")
-		}
-		if strings.HasPrefix(token, "scope") {
-			sc.Scope = parseScope(strings.Trim(token[len("scope="):], "\""))
+	challenges := sc.Challenges.Challenges(pingURL)
+	if len(challenges) == 0 {
+		if _, err := sc.PingV2(endpoint); err != nil {
+			return err
 		}
+		challenges = sc.Challenges.Challenges(pingURL)
+	} else {
+		// PingV2 records the host on a fresh probe; a cached endpoint
+		// still needs it so its tokens are stored under the right host.
+		sc.ReqHost = indexServer
 	}
 
-	if sc.Realm == "" {
-		return fmt.Errorf("missing realm in bearer with challenge")
+	if len(challenges) == 0 {
+		return fmt.Errorf("missing www-authenticate challenge in response from %s", endpoint)
 	}
 
-	if sc.Service == "" {
-		return fmt.Errorf("missing service in bearer with challenge")
-	}
-
-	return sc.getAuthToken(inputURL)
-}
-
-// Get auth token from the token server.
-// For example it's equivalent to:
-//
-// $ curl "https://auth.docker.io/token?service=registry.docker.io&scope=repository:library/busybox:pull"
-//
-func (sc *RegAuthContext) getAuthToken(inputURL string) error {
-	authReq, err := http.NewRequest("GET", sc.Realm, nil)
+	challenge, err := selectChallenge(challenges)
 	if err != nil {
-		return fmt.Errorf("cannot send HTTP request to %s: %v", sc.Realm, err)
+		return err
 	}
 
-	getParams := authReq.URL.Query()
-	getParams.Add("service", sc.Service)
-	if sc.Scope.Actions != "" {
-		getParams.Add("scope", fmt.Sprintf("repository:%s:%s", sc.Scope.RemoteName, sc.Scope.Actions))
+	sc.AuthScheme = challenge.Scheme
+	sc.Realm = challenge.Parameters["realm"]
+	sc.Service = challenge.Parameters["service"]
+	if scope, ok := challenge.Parameters["scope"]; ok {
+		sc.Scope = parseScope(scope)
 	}
-	authReq.URL.RawQuery = getParams.Encode()
 
-	res, err := sc.Hclient.Do(authReq)
-	if err != nil {
-		return fmt.Errorf("failed to send auth request: %v", err)
-	}
-	defer res.Body.Close()
-
-	switch res.StatusCode {
-	case http.StatusUnauthorized:
-		return fmt.Errorf("unable to retrieve auth token: 401 unauthorized")
-	case http.StatusOK:
-		break
+	switch sc.AuthScheme {
+	case "bearer":
+		if sc.Realm == "" {
+			return fmt.Errorf("missing realm in bearer challenge")
+		}
+		if sc.Service == "" {
+			return fmt.Errorf("missing service in bearer challenge")
+		}
+		return sc.getAuthToken(pingURL)
+	case "basic":
+		// Nothing to fetch up front: SendRequestWithToken consults
+		// sc.Creds and attaches Authorization: Basic per request.
+		return nil
 	default:
-		return fmt.Errorf("statusCode = %v, request URL = %v", res.StatusCode, authReq.URL)
+		return fmt.Errorf("unsupported auth scheme %q offered by %s", challenge.Scheme, sc.ReqHost)
 	}
+}
 
-	tokenBlob, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return fmt.Errorf("failed to read token from body: %v", err)
+// selectChallenge picks the strongest scheme this module knows how to
+// handle out of the challenges a registry advertised, preferring Bearer
+// over Basic when both are offered.
+func selectChallenge(challenges []Challenge) (Challenge, error) {
+	var basic *Challenge
+	for i := range challenges {
+		switch challenges[i].Scheme {
+		case "bearer":
+			return challenges[i], nil
+		case "basic":
+			basic = &challenges[i]
+		}
 	}
-
-	var tokenStruct TokenStruct
-	if err := json.Unmarshal(tokenBlob, &tokenStruct); err != nil {
-		return fmt.Errorf("failed to unmarshal json for token: %v", err)
+	if basic != nil {
+		return *basic, nil
 	}
+	return Challenge{}, fmt.Errorf("no supported auth scheme found in challenges")
+}
 
-	sc.AuthTokens[sc.ReqHost] = tokenStruct.Token
+// getAuthToken obtains a token for the context's current realm, service
+// and scope and verifies it works by replaying the original request.
+func (sc *RegAuthContext) getAuthToken(inputURL string) error {
+	if err := sc.refreshToken(); err != nil {
+		return err
+	}
 
 	if _, _, err := sc.SendRequestWithToken(inputURL, "GET", nil); err != nil {
 		return fmt.Errorf("failed to send request to %s: %v", inputURL, err)
@@ -171,52 +200,128 @@ func (sc *RegAuthContext) getAuthToken(inputURL string) error {
 //
 // $ curl -H "Authorization: Bearer TOKEN_STRING" https://index.docker.io/v2/library/busybox/manifests/latest
 //
+// If the registry responds 401 with a fresh WWW-Authenticate challenge
+// (e.g. because the request needs a different scope than the one
+// currently cached, such as a push to a repository we've only ever
+// pulled from), the request is retried once against the newly required
+// scope. Requests with a body, or that went out without credentials, are
+// not retried.
 func (sc *RegAuthContext) SendRequestWithToken(inputURL, method string, body io.Reader) (*http.Request, *http.Response, error) {
-	setBearerHeader := false
-
-	req, err := http.NewRequest(method, inputURL, nil)
+	req, err := http.NewRequest(method, inputURL, body)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to send request to %s: %v", inputURL, err)
 	}
 
-	authToken, ok := sc.AuthTokens[req.URL.Host]
-	if ok {
-		req.Header.Set("Authorization", "Bearer "+authToken)
-		setBearerHeader = true
+	authSet, err := sc.setAuthHeader(req)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	res, err := sc.Hclient.Do(req)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to send auth request: %v", err)
 	}
+
+	if res.StatusCode != http.StatusUnauthorized {
+		return req, res, nil
+	}
 	defer res.Body.Close()
 
-	if res.StatusCode == http.StatusUnauthorized && setBearerHeader {
+	// Only retry when the first attempt carried credentials and had no
+	// request body (a body reader can't be replayed), and when the server
+	// actually told us how to get a usable token.
+	if !authSet || body != nil {
 		return nil, nil, fmt.Errorf("received invalid result: %v", res)
 	}
 
-	return req, res, nil
-}
+	challenges := ParseAuthHeader(res.Header)
+	challenge, err := selectChallenge(challenges)
+	if err != nil {
+		return nil, nil, fmt.Errorf("received invalid result: %v", res)
+	}
+
+	sc.AuthScheme = challenge.Scheme
+	if realm, ok := challenge.Parameters["realm"]; ok {
+		sc.Realm = realm
+	}
+	if service, ok := challenge.Parameters["service"]; ok {
+		sc.Service = service
+	}
+	if scope, ok := challenge.Parameters["scope"]; ok {
+		sc.Scope = parseScope(scope)
+	}
+
+	if sc.AuthScheme != "basic" {
+		if err := sc.refreshToken(); err != nil {
+			return nil, nil, fmt.Errorf("failed to refresh auth token for new scope: %v", err)
+		}
+	}
 
-func newHTTPClient() *http.Client {
-	dialer := &net.Dialer{
-		Timeout:   30 * time.Second,
-		KeepAlive: 30 * time.Second,
+	retryReq, err := http.NewRequest(method, inputURL, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to send request to %s: %v", inputURL, err)
+	}
+	if _, err := sc.setAuthHeader(retryReq); err != nil {
+		return nil, nil, err
 	}
 
-	tr := &http.Transport{
-		Proxy:               http.ProxyFromEnvironment,
-		Dial:                dialer.Dial,
-		TLSHandshakeTimeout: 10 * time.Second,
+	retryRes, err := sc.Hclient.Do(retryReq)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to send auth request: %v", err)
+	}
+	if retryRes.StatusCode == http.StatusUnauthorized {
+		return nil, nil, fmt.Errorf("received invalid result: %v", retryRes)
 	}
 
-	tr.TLSClientConfig = &tls.Config{
-		InsecureSkipVerify: true,
+	return retryReq, retryRes, nil
+}
+
+// setAuthHeader attaches whatever credentials are appropriate for req
+// given sc's current auth scheme, refreshing a stale bearer token along
+// the way, and reports whether it set anything.
+func (sc *RegAuthContext) setAuthHeader(req *http.Request) (bool, error) {
+	switch sc.AuthScheme {
+	case "basic":
+		if sc.Creds != nil {
+			if user, pass := sc.Creds.Basic(req.URL); user != "" {
+				req.SetBasicAuth(user, pass)
+				return true, nil
+			}
+		}
+		return false, nil
+	default:
+		key := tokenCacheKey{host: req.URL.Host, scope: scopeString(sc.Scope)}
+		tok, ok := sc.AuthTokens.get(key)
+		if ok && !time.Now().Before(tok.Expiry) {
+			if err := sc.refreshToken(); err != nil {
+				return false, fmt.Errorf("failed to refresh auth token: %v", err)
+			}
+			tok, ok = sc.AuthTokens.get(key)
+		}
+		if !ok {
+			return false, nil
+		}
+		req.Header.Set("Authorization", "Bearer "+tok.Token)
+		return true, nil
 	}
+}
 
-	return &http.Client{
-		Transport: tr,
+// AuthorizeScopes pre-fetches tokens for each of the given scopes in one
+// pass, so a batch of operations that each need a different scope (e.g.
+// a cross-repository blob mount, which needs pull on the source
+// repository and push on the destination) don't each pay for a token
+// round trip on first use.
+func (sc *RegAuthContext) AuthorizeScopes(scopes []AuthScope) error {
+	original := sc.Scope
+	defer func() { sc.Scope = original }()
+
+	for _, scope := range scopes {
+		sc.Scope = scope
+		if err := sc.refreshToken(); err != nil {
+			return fmt.Errorf("failed to authorize scope %s: %v", scopeString(scope), err)
+		}
 	}
+	return nil
 }
 
 func parseScope(inputScope string) AuthScope {
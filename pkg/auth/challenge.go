@@ -0,0 +1,149 @@
+// Copyright © 2018 ocicert authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Challenge is a single authentication challenge carried by a
+// WWW-Authenticate header, e.g. `Bearer realm="...",service="...",scope="..."`.
+type Challenge struct {
+	Scheme     string
+	Parameters map[string]string
+}
+
+// ParseAuthHeader tokenizes every WWW-Authenticate challenge present in h
+// into a Challenge per RFC 7235 (and RFC 2617 for Basic). A response may
+// carry several challenges, either as repeated header values or several
+// auth-schemes comma-separated within one value, and parameter values may
+// be quoted-strings containing commas and escaped quotes (e.g.
+// scope="repository:foo,bar:pull"), so a naive split on "," is not enough.
+func ParseAuthHeader(h http.Header) []Challenge {
+	var challenges []Challenge
+	for _, header := range h[http.CanonicalHeaderKey("WWW-Authenticate")] {
+		challenges = append(challenges, parseChallenges(header)...)
+	}
+	return challenges
+}
+
+// parseChallenges splits a single WWW-Authenticate header value into its
+// component challenges and parses the auth-params of each.
+func parseChallenges(header string) []Challenge {
+	var challenges []Challenge
+
+	rest := strings.TrimSpace(header)
+	for rest != "" {
+		var scheme string
+		scheme, rest = consumeToken(rest)
+		if scheme == "" {
+			break
+		}
+
+		var params map[string]string
+		params, rest = consumeParams(rest)
+
+		challenges = append(challenges, Challenge{
+			Scheme:     strings.ToLower(scheme),
+			Parameters: params,
+		})
+	}
+
+	return challenges
+}
+
+// consumeParams consumes the comma-separated auth-param list following a
+// scheme token, stopping as soon as it sees what looks like the start of
+// the next challenge (a bare token not followed by "="). It returns the
+// parsed params and whatever of s remains unconsumed.
+func consumeParams(s string) (map[string]string, string) {
+	params := make(map[string]string)
+
+	s = skipSpace(s)
+	for {
+		save := s
+		key, afterKey := consumeToken(s)
+		if key == "" {
+			return params, s
+		}
+		afterKey = skipSpace(afterKey)
+		if !strings.HasPrefix(afterKey, "=") {
+			// This token isn't "key=value": it's the next challenge's
+			// scheme, so leave it unconsumed for the caller.
+			return params, save
+		}
+
+		value, rest := consumeTokenOrQuoted(afterKey[1:])
+		params[strings.ToLower(key)] = value
+
+		rest = skipSpace(rest)
+		if !strings.HasPrefix(rest, ",") {
+			return params, rest
+		}
+		s = skipSpace(rest[1:])
+	}
+}
+
+func skipSpace(s string) string {
+	return strings.TrimLeft(s, " \t")
+}
+
+// consumeToken reads a run of RFC 2616 token characters off the front of
+// s, returning the token and the remainder.
+func consumeToken(s string) (token, rest string) {
+	i := 0
+	for ; i < len(s); i++ {
+		if !isTokenChar(s[i]) {
+			break
+		}
+	}
+	return s[:i], s[i:]
+}
+
+// consumeTokenOrQuoted reads an auth-param value, which is either a bare
+// token or a quoted-string that may contain escaped characters.
+func consumeTokenOrQuoted(s string) (value, rest string) {
+	if !strings.HasPrefix(s, "\"") {
+		return consumeToken(s)
+	}
+
+	var b strings.Builder
+	escaped := false
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case escaped:
+			b.WriteByte(c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			return b.String(), s[i+1:]
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	// Unterminated quoted-string: treat everything we saw as the value.
+	return b.String(), ""
+}
+
+func isTokenChar(c byte) bool {
+	if c <= 32 || c == 127 {
+		return false
+	}
+	return !strings.ContainsRune(`()<>@,;:\"/[]?={} `, rune(c))
+}
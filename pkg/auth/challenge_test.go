@@ -0,0 +1,92 @@
+// Copyright © 2018 ocicert authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestParseAuthHeaderEmbeddedCommaInQuotedScope(t *testing.T) {
+	h := http.Header{}
+	h.Set("WWW-Authenticate", `Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:foo,bar:pull"`)
+
+	challenges := ParseAuthHeader(h)
+	if len(challenges) != 1 {
+		t.Fatalf("got %d challenges, want 1: %+v", len(challenges), challenges)
+	}
+
+	want := Challenge{
+		Scheme: "bearer",
+		Parameters: map[string]string{
+			"realm":   "https://auth.example.com/token",
+			"service": "registry.example.com",
+			"scope":   "repository:foo,bar:pull",
+		},
+	}
+	if !reflect.DeepEqual(challenges[0], want) {
+		t.Errorf("got %+v, want %+v", challenges[0], want)
+	}
+}
+
+func TestParseAuthHeaderMultipleChallengesInOneValue(t *testing.T) {
+	h := http.Header{}
+	h.Set("WWW-Authenticate", `Basic realm="x", Bearer realm="y"`)
+
+	challenges := ParseAuthHeader(h)
+	if len(challenges) != 2 {
+		t.Fatalf("got %d challenges, want 2: %+v", len(challenges), challenges)
+	}
+
+	if challenges[0].Scheme != "basic" || challenges[0].Parameters["realm"] != "x" {
+		t.Errorf("first challenge = %+v, want scheme basic realm x", challenges[0])
+	}
+	if challenges[1].Scheme != "bearer" || challenges[1].Parameters["realm"] != "y" {
+		t.Errorf("second challenge = %+v, want scheme bearer realm y", challenges[1])
+	}
+}
+
+func TestParseAuthHeaderEscapedQuotes(t *testing.T) {
+	h := http.Header{}
+	h.Set("WWW-Authenticate", `Basic realm="a\"b"`)
+
+	challenges := ParseAuthHeader(h)
+	if len(challenges) != 1 {
+		t.Fatalf("got %d challenges, want 1: %+v", len(challenges), challenges)
+	}
+
+	if got, want := challenges[0].Parameters["realm"], `a"b`; got != want {
+		t.Errorf("realm = %q, want %q", got, want)
+	}
+}
+
+func TestParseAuthHeaderRepeatedHeaderLines(t *testing.T) {
+	h := http.Header{}
+	h.Add("WWW-Authenticate", `Basic realm="x"`)
+	h.Add("WWW-Authenticate", `Bearer realm="y",service="z"`)
+
+	challenges := ParseAuthHeader(h)
+	if len(challenges) != 2 {
+		t.Fatalf("got %d challenges, want 2: %+v", len(challenges), challenges)
+	}
+
+	if challenges[0].Scheme != "basic" || challenges[0].Parameters["realm"] != "x" {
+		t.Errorf("first challenge = %+v, want scheme basic realm x", challenges[0])
+	}
+	if challenges[1].Scheme != "bearer" || challenges[1].Parameters["realm"] != "y" || challenges[1].Parameters["service"] != "z" {
+		t.Errorf("second challenge = %+v, want scheme bearer realm y service z", challenges[1])
+	}
+}
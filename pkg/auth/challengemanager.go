@@ -0,0 +1,67 @@
+// Copyright © 2018 ocicert authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// ChallengeManager records the auth challenges advertised by registry
+// endpoints, keyed by their canonical URL, so a RegAuthContext can be
+// reused across many endpoints without re-issuing the unauthenticated
+// probe (and re-parsing WWW-Authenticate) on every operation.
+type ChallengeManager struct {
+	mu         sync.RWMutex
+	challenges map[string][]Challenge
+}
+
+// NewChallengeManager returns an empty ChallengeManager.
+func NewChallengeManager() *ChallengeManager {
+	return &ChallengeManager{challenges: make(map[string][]Challenge)}
+}
+
+// Challenges returns the challenges previously recorded for endpoint, or
+// nil if none have been recorded yet.
+func (m *ChallengeManager) Challenges(endpoint string) []Challenge {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.challenges[canonicalEndpoint(endpoint)]
+}
+
+// AddChallenges records the challenges carried by res's headers against
+// endpoint. It's a no-op if res advertises no challenges.
+func (m *ChallengeManager) AddChallenges(endpoint string, res *http.Response) {
+	challenges := ParseAuthHeader(res.Header)
+	if len(challenges) == 0 {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.challenges[canonicalEndpoint(endpoint)] = challenges
+}
+
+func canonicalEndpoint(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return endpoint
+	}
+	u.Host = strings.ToLower(u.Host)
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	return u.String()
+}
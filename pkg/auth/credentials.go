@@ -0,0 +1,51 @@
+// Copyright © 2018 ocicert authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import "net/url"
+
+// CredentialStore is consulted whenever a RegAuthContext needs
+// credentials to authenticate against a registry or its token server.
+// Implementations may return empty values for methods they don't
+// support.
+type CredentialStore interface {
+	// Basic returns the username and password to present for HTTP
+	// Basic authentication against the given URL.
+	Basic(u *url.URL) (username, password string)
+
+	// RefreshToken returns a previously obtained refresh (identity)
+	// token for the given token server and service, if any.
+	RefreshToken(u *url.URL, service string) string
+}
+
+// NewBasicCredentialStore returns a CredentialStore that always presents
+// the given static username and password, for registries and token
+// servers that only support HTTP Basic / OAuth2 password grant.
+func NewBasicCredentialStore(username, password string) CredentialStore {
+	return &basicCredentialStore{username: username, password: password}
+}
+
+type basicCredentialStore struct {
+	username string
+	password string
+}
+
+func (s *basicCredentialStore) Basic(*url.URL) (string, string) {
+	return s.username, s.password
+}
+
+func (s *basicCredentialStore) RefreshToken(*url.URL, string) string {
+	return ""
+}
@@ -0,0 +1,66 @@
+// Copyright © 2018 ocicert authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// PingV2 probes endpoint's /v2/ API, recording whatever auth challenges
+// it advertises in sc.Challenges and reporting whether the registry
+// actually speaks the v2 protocol. Callers that only need the
+// challenges (to decide how to authenticate) rather than a v1/v2 error
+// can ignore a non-nil error as long as the returned manager has
+// challenges for the endpoint.
+func (sc *RegAuthContext) PingV2(endpoint string) (*ChallengeManager, error) {
+	if sc.Challenges == nil {
+		sc.Challenges = NewChallengeManager()
+	}
+
+	pingURL := strings.TrimSuffix(endpoint, "/") + "/v2/"
+
+	req, err := http.NewRequest("GET", pingURL, nil)
+	if err != nil {
+		return sc.Challenges, fmt.Errorf("failed to build request to %s: %v", pingURL, err)
+	}
+
+	res, err := sc.Hclient.Do(req)
+	if err != nil {
+		return sc.Challenges, fmt.Errorf("failed to ping %s: %v", pingURL, err)
+	}
+	defer res.Body.Close()
+
+	sc.ReqHost = req.URL.Host
+	sc.Challenges.AddChallenges(pingURL, res)
+
+	if !looksLikeV2(res) {
+		return sc.Challenges, fmt.Errorf("endpoint %s does not speak the registry v2 protocol", endpoint)
+	}
+
+	return sc.Challenges, nil
+}
+
+// looksLikeV2 reports whether res indicates the registry speaks the v2
+// API: either it sets the distribution API version header, or it gives
+// a definite v2 answer (200 without auth, or 401 asking us to
+// authenticate) to the /v2/ probe.
+func looksLikeV2(res *http.Response) bool {
+	if res.Header.Get("Docker-Distribution-Api-Version") == "registry/2.0" {
+		return true
+	}
+	return res.StatusCode == http.StatusOK || res.StatusCode == http.StatusUnauthorized
+}
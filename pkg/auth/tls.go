@@ -0,0 +1,157 @@
+// Copyright © 2018 ocicert authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultCertsDir is where per-registry TLS material is looked up by
+// default, following Docker's certs.d convention of
+// <dir>/<host>/{ca.crt,*.cert,*.key}.
+const DefaultCertsDir = "/etc/docker/certs.d"
+
+// Options configures the HTTP client a RegAuthContext talks to
+// registries with.
+type Options struct {
+	// Insecure disables TLS certificate verification entirely. Only
+	// meant for local/testing use against registries with self-signed
+	// or otherwise untrusted certificates.
+	Insecure bool
+
+	// CertsDir, when set, is searched for per-host CA bundles and
+	// client certificate/key pairs under CertsDir/<host>/, following
+	// Docker's certs.d convention. Every *.crt found anywhere under
+	// CertsDir is added to the system root pool, and every *.cert/*.key
+	// pair is offered as a client certificate, regardless of which
+	// host's subdirectory it came from: the Transport needs a single
+	// TLSClientConfig that also covers requests tunneled through an
+	// HTTPS_PROXY, and that config has no per-host hook to hang
+	// host-specific material off of the way a direct dial would.
+	CertsDir string
+
+	// DialTimeout bounds how long to wait when establishing the TCP
+	// connection. Defaults to 30 seconds.
+	DialTimeout time.Duration
+}
+
+func newHTTPClient(opts Options) (*http.Client, error) {
+	dialTimeout := opts.DialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = 30 * time.Second
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	tlsConfig, err := newTLSConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		Dial:                dialer.Dial,
+		TLSHandshakeTimeout: 10 * time.Second,
+		TLSClientConfig:     tlsConfig,
+	}
+
+	return &http.Client{
+		Transport: tr,
+	}, nil
+}
+
+// newTLSConfig builds the tls.Config the Transport uses for every
+// connection, direct or proxied. Setting this once on TLSClientConfig,
+// rather than picking a per-host config from a DialTLS hook, is what
+// makes the certs.d/mTLS material apply to requests tunneled through an
+// HTTPS_PROXY: Transport only consults DialTLS for non-proxied requests,
+// but always consults TLSClientConfig.
+func newTLSConfig(opts Options) (*tls.Config, error) {
+	if opts.Insecure {
+		return &tls.Config{InsecureSkipVerify: true}, nil
+	}
+
+	cfg := &tls.Config{}
+	if opts.CertsDir == "" {
+		return cfg, nil
+	}
+
+	hostDirs, err := ioutil.ReadDir(opts.CertsDir)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certs dir %s: %v", opts.CertsDir, err)
+	}
+
+	var pool *x509.CertPool
+	for _, hostDir := range hostDirs {
+		if !hostDir.IsDir() {
+			continue
+		}
+
+		dir := filepath.Join(opts.CertsDir, hostDir.Name())
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read certs dir %s: %v", dir, err)
+		}
+
+		for _, entry := range entries {
+			name := entry.Name()
+			switch {
+			case strings.HasSuffix(name, ".crt"):
+				pem, err := ioutil.ReadFile(filepath.Join(dir, name))
+				if err != nil {
+					return nil, fmt.Errorf("failed to read CA bundle %s: %v", name, err)
+				}
+				if pool == nil {
+					if sysPool, err := x509.SystemCertPool(); err == nil && sysPool != nil {
+						pool = sysPool
+					} else {
+						pool = x509.NewCertPool()
+					}
+				}
+				if !pool.AppendCertsFromPEM(pem) {
+					return nil, fmt.Errorf("failed to parse CA bundle %s", name)
+				}
+			case strings.HasSuffix(name, ".cert"):
+				keyName := strings.TrimSuffix(name, ".cert") + ".key"
+				cert, err := tls.LoadX509KeyPair(filepath.Join(dir, name), filepath.Join(dir, keyName))
+				if err != nil {
+					return nil, fmt.Errorf("failed to load client certificate %s: %v", name, err)
+				}
+				cfg.Certificates = append(cfg.Certificates, cert)
+			}
+		}
+	}
+
+	if pool != nil {
+		cfg.RootCAs = pool
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,241 @@
+// Copyright © 2018 ocicert authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minTokenLifetime is the shortest expiry this module will honor for a
+// token server response; servers that advertise anything shorter (or
+// nothing at all) get bumped up to it so callers don't thrash refreshing.
+const minTokenLifetime = 60 * time.Second
+
+// tokenInfo is what gets cached for a (host, scope) pair: the bearer
+// token itself, its expiry, and a refresh token to use for the next
+// exchange if the server handed one out.
+type tokenInfo struct {
+	Token        string
+	RefreshToken string
+	Expiry       time.Time
+}
+
+// tokenCacheKey identifies a cached token. Tokens are scoped to a single
+// repository and set of actions, so a token obtained for a pull against
+// one repository must not be handed out for a push against another.
+type tokenCacheKey struct {
+	host  string
+	scope string
+}
+
+// tokenCache is a (host, scope) -> tokenInfo map safe for concurrent
+// use, so a single RegAuthContext can be shared across goroutines
+// issuing requests against different scopes at once (e.g. parallel blob
+// pulls/pushes).
+type tokenCache struct {
+	mu     sync.RWMutex
+	tokens map[tokenCacheKey]tokenInfo
+}
+
+func newTokenCache() *tokenCache {
+	return &tokenCache{tokens: make(map[tokenCacheKey]tokenInfo)}
+}
+
+func (c *tokenCache) get(key tokenCacheKey) (tokenInfo, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	tok, ok := c.tokens[key]
+	return tok, ok
+}
+
+func (c *tokenCache) set(key tokenCacheKey, tok tokenInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tokens[key] = tok
+}
+
+// scopeString renders an AuthScope the way it's sent to the token
+// server, e.g. "repository:library/busybox:pull".
+func scopeString(scope AuthScope) string {
+	return fmt.Sprintf("repository:%s:%s", scope.RemoteName, scope.Actions)
+}
+
+// tokenResponse covers the fields a distribution token server may
+// return. Both "token" and "access_token" carry the same thing per the
+// distribution token spec; "issued_at" plus "expires_in" let us compute
+// an absolute expiry.
+type tokenResponse struct {
+	Token        string `json:"token"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	IssuedAt     string `json:"issued_at"`
+}
+
+// refreshToken fetches a fresh token for the context's current realm,
+// service and scope and stores it in AuthTokens keyed by ReqHost. It
+// uses the OAuth2 flow (POSTing a refresh_token or password grant) when
+// credentials or a cached refresh token are available, and falls back to
+// the classic anonymous GET otherwise.
+func (sc *RegAuthContext) refreshToken() error {
+	realmURL, err := url.Parse(sc.Realm)
+	if err != nil {
+		return fmt.Errorf("invalid realm %q: %v", sc.Realm, err)
+	}
+
+	key := tokenCacheKey{host: sc.ReqHost, scope: scopeString(sc.Scope)}
+
+	var username, password, refresh string
+	if sc.Creds != nil {
+		username, password = sc.Creds.Basic(realmURL)
+		refresh = sc.Creds.RefreshToken(realmURL, sc.Service)
+	}
+	if refresh == "" {
+		if cached, ok := sc.AuthTokens.get(key); ok {
+			refresh = cached.RefreshToken
+		}
+	}
+
+	var tok tokenInfo
+	if refresh != "" || password != "" {
+		tok, err = sc.fetchOAuth2Token(username, password, refresh)
+	} else {
+		tok, err = sc.fetchAnonymousToken()
+	}
+	if err != nil {
+		return err
+	}
+	if tok.RefreshToken == "" {
+		tok.RefreshToken = refresh
+	}
+
+	sc.AuthTokens.set(key, tok)
+
+	return nil
+}
+
+// fetchAnonymousToken performs the classic, unauthenticated token
+// request:
+//
+// $ curl "https://auth.docker.io/token?service=registry.docker.io&scope=repository:library/busybox:pull"
+func (sc *RegAuthContext) fetchAnonymousToken() (tokenInfo, error) {
+	authReq, err := http.NewRequest("GET", sc.Realm, nil)
+	if err != nil {
+		return tokenInfo{}, fmt.Errorf("cannot send HTTP request to %s: %v", sc.Realm, err)
+	}
+
+	getParams := authReq.URL.Query()
+	getParams.Add("service", sc.Service)
+	if sc.Scope.Actions != "" {
+		getParams.Add("scope", scopeString(sc.Scope))
+	}
+	authReq.URL.RawQuery = getParams.Encode()
+
+	res, err := sc.Hclient.Do(authReq)
+	if err != nil {
+		return tokenInfo{}, fmt.Errorf("failed to send auth request: %v", err)
+	}
+	defer res.Body.Close()
+
+	return parseTokenResponse(res)
+}
+
+// fetchOAuth2Token performs the OAuth2 token exchange described by the
+// distribution spec: a refresh_token grant when a refresh/identity token
+// is available, otherwise a password grant.
+func (sc *RegAuthContext) fetchOAuth2Token(username, password, refreshToken string) (tokenInfo, error) {
+	form := url.Values{}
+	form.Set("service", sc.Service)
+	form.Set("client_id", "ocicert")
+	if sc.Scope.Actions != "" {
+		form.Set("scope", scopeString(sc.Scope))
+	}
+
+	if refreshToken != "" {
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", refreshToken)
+	} else {
+		form.Set("grant_type", "password")
+		form.Set("username", username)
+		form.Set("password", password)
+	}
+
+	authReq, err := http.NewRequest("POST", sc.Realm, strings.NewReader(form.Encode()))
+	if err != nil {
+		return tokenInfo{}, fmt.Errorf("cannot send HTTP request to %s: %v", sc.Realm, err)
+	}
+	authReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := sc.Hclient.Do(authReq)
+	if err != nil {
+		return tokenInfo{}, fmt.Errorf("failed to send auth request: %v", err)
+	}
+	defer res.Body.Close()
+
+	return parseTokenResponse(res)
+}
+
+func parseTokenResponse(res *http.Response) (tokenInfo, error) {
+	switch res.StatusCode {
+	case http.StatusUnauthorized:
+		return tokenInfo{}, fmt.Errorf("unable to retrieve auth token: 401 unauthorized")
+	case http.StatusOK:
+	default:
+		return tokenInfo{}, fmt.Errorf("statusCode = %v, request URL = %v", res.StatusCode, res.Request.URL)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return tokenInfo{}, fmt.Errorf("failed to read token from body: %v", err)
+	}
+
+	var parsed tokenResponse
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return tokenInfo{}, fmt.Errorf("failed to unmarshal json for token: %v", err)
+	}
+
+	token := parsed.Token
+	if token == "" {
+		token = parsed.AccessToken
+	}
+	if token == "" {
+		return tokenInfo{}, fmt.Errorf("token response did not contain a token")
+	}
+
+	expiresIn := time.Duration(parsed.ExpiresIn) * time.Second
+	if parsed.ExpiresIn == 0 || expiresIn < minTokenLifetime {
+		expiresIn = minTokenLifetime
+	}
+
+	issuedAt := time.Now().UTC()
+	if parsed.IssuedAt != "" {
+		if t, err := time.Parse(time.RFC3339, parsed.IssuedAt); err == nil {
+			issuedAt = t
+		}
+	}
+
+	return tokenInfo{
+		Token:        token,
+		RefreshToken: parsed.RefreshToken,
+		Expiry:       issuedAt.Add(expiresIn),
+	}, nil
+}
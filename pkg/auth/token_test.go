@@ -0,0 +1,44 @@
+// Copyright © 2018 ocicert authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"sync"
+	"testing"
+)
+
+// TestTokenCacheConcurrentAccess exercises the cache the way a shared
+// RegAuthContext is meant to be used: many goroutines setting and
+// getting the same (host, scope) token at once. Run with -race to catch
+// regressions back to a plain map.
+func TestTokenCacheConcurrentAccess(t *testing.T) {
+	cache := newTokenCache()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		key := tokenCacheKey{host: "registry.example.com", scope: scopeString(AuthScope{RemoteName: "repo", Actions: "pull"})}
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			cache.set(key, tokenInfo{Token: "t"})
+		}()
+		go func() {
+			defer wg.Done()
+			cache.get(key)
+		}()
+	}
+	wg.Wait()
+}